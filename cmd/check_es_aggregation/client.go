@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// apiKeyTransport adds an "Authorization: ApiKey <key>" header to every
+// outgoing request. olivere/elastic.v5 has no native API key support, so we
+// piggyback on SetHttpClient instead.
+type apiKeyTransport struct {
+	key  string
+	next http.RoundTripper
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "ApiKey "+t.key)
+	return t.next.RoundTrip(req)
+}
+
+// buildHTTPClient returns a *http.Client configured for TLS verification
+// and/or API key auth, or nil if none of those were requested (in which
+// case the caller should leave elastic's default client in place).
+func buildHTTPClient(cfg *args) (*http.Client, error) {
+	if *cfg.caCert == "" && !*cfg.insecureSkipVerify && *cfg.apiKey == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *cfg.insecureSkipVerify}
+	if *cfg.caCert != "" {
+		pem, err := ioutil.ReadFile(*cfg.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate %s: %s", *cfg.caCert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse CA certificate %s", *cfg.caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	var transport http.RoundTripper = &http.Transport{TLSClientConfig: tlsConfig}
+	if *cfg.apiKey != "" {
+		transport = &apiKeyTransport{key: *cfg.apiKey, next: transport}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// buildClientOptions assembles the elastic.ClientOptionFunc slice used to
+// construct the client from the --es-url/--retries/--sniff/... flags.
+func buildClientOptions(cfg *args, logger *log.Logger) ([]elastic.ClientOptionFunc, error) {
+	urls := strings.Split(*cfg.elasticsearchURL, ",")
+	for i, u := range urls {
+		urls[i] = strings.TrimSpace(u)
+	}
+
+	opts := []elastic.ClientOptionFunc{
+		elastic.SetURL(urls...),
+		elastic.SetSniff(*cfg.sniff),
+		elastic.SetMaxRetries(*cfg.retries),
+	}
+
+	if logger != nil {
+		opts = append(opts, elastic.SetTraceLog(logger))
+	}
+
+	if *cfg.healthcheckInterval > 0 {
+		opts = append(opts, elastic.SetHealthcheckInterval(*cfg.healthcheckInterval))
+	} else {
+		opts = append(opts, elastic.SetHealthcheck(false))
+	}
+
+	if *cfg.basicAuth != "" {
+		user, pass, err := splitBasicAuth(*cfg.basicAuth)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, elastic.SetBasicAuth(user, pass))
+	}
+
+	httpClient, err := buildHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		opts = append(opts, elastic.SetHttpClient(httpClient))
+	}
+
+	return opts, nil
+}
+
+func splitBasicAuth(in string) (string, string, error) {
+	parts := strings.SplitN(in, ":", 2)
+	if len(parts) != 2 {
+		return "", "", &ArgumentMissingError{"--basic-auth must be given as user:pass"}
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v5"
+
+	"github.com/olorin/nagiosplugin"
+)
+
+// compositeDefaultPageSize bounds how many buckets are requested per
+// composite aggregation page when paginating via after_key.
+const compositeDefaultPageSize = 100
+
+// bucketResult is the per-bucket outcome of a --bucket-by composite
+// aggregation check.
+type bucketResult struct {
+	key   string
+	value float64
+}
+
+// compositeAggregation is a hand-rolled elastic.Aggregation. olivere's
+// elastic.v5 targets Elasticsearch 5.x and has no typed builder for the
+// composite aggregation (added in ES 6.1), so we build its JSON body
+// ourselves the same way esquery's CustomAgg technique works: anything
+// satisfying elastic.Aggregation only needs a Source() method.
+type compositeAggregation struct {
+	fields  []string
+	size    int
+	after   map[string]interface{}
+	subName string
+	subAgg  elastic.Aggregation
+}
+
+func newCompositeAggregation(fields []string) *compositeAggregation {
+	return &compositeAggregation{fields: fields, size: compositeDefaultPageSize}
+}
+
+func (c *compositeAggregation) Size(size int) *compositeAggregation {
+	c.size = size
+	return c
+}
+
+func (c *compositeAggregation) After(after map[string]interface{}) *compositeAggregation {
+	c.after = after
+	return c
+}
+
+func (c *compositeAggregation) SubAggregation(name string, agg elastic.Aggregation) *compositeAggregation {
+	c.subName = name
+	c.subAgg = agg
+	return c
+}
+
+func (c *compositeAggregation) Source() (interface{}, error) {
+	sources := make([]interface{}, 0, len(c.fields))
+	for _, field := range c.fields {
+		sources = append(sources, map[string]interface{}{
+			field: map[string]interface{}{
+				"terms": map[string]interface{}{"field": field},
+			},
+		})
+	}
+
+	composite := map[string]interface{}{
+		"size":    c.size,
+		"sources": sources,
+	}
+	if c.after != nil {
+		composite["after"] = c.after
+	}
+
+	source := map[string]interface{}{"composite": composite}
+
+	if c.subAgg != nil {
+		subSource, err := c.subAgg.Source()
+		if err != nil {
+			return nil, err
+		}
+		source["aggregations"] = map[string]interface{}{c.subName: subSource}
+	}
+
+	return source, nil
+}
+
+// AddCompositeAggregation sets up a composite aggregation bucketed by fields,
+// with the usual metric sub-aggregation (see AddSubAggregation) computed per
+// bucket. Elasticsearch requires composite to be the top-level aggregation,
+// so unlike AddSubAggregation it becomes the searcher's outerAggregation
+// instead of nesting under the date-range bucket; newSearcher bounds the
+// time window with a query filter instead in this mode.
+func (s *searcher) AddCompositeAggregation(fields []string, metricField string, metricName string, params ...interface{}) *searcher {
+	metricAgg, aggName := s.buildMetricAggregation(metricField, metricName, params...)
+	if metricAgg == nil {
+		return s
+	}
+
+	s.aggName = aggName
+	s.composite = newCompositeAggregation(fields).SubAggregation(aggName, metricAgg)
+	return s
+}
+
+// SearchComposite runs the composite aggregation query, paginating via
+// after_key until either Elasticsearch has no more buckets to return or
+// maxBuckets results have been collected. maxBuckets <= 0 means unbounded.
+func (s *searcher) SearchComposite(maxBuckets int) ([]bucketResult, error) {
+	pageSize := compositeDefaultPageSize
+	if maxBuckets > 0 && maxBuckets < pageSize {
+		pageSize = maxBuckets
+	}
+	s.composite.Size(pageSize)
+
+	var results []bucketResult
+	var after map[string]interface{}
+
+	for {
+		s.composite.After(after)
+
+		res, err := s.es.Search(s.idx).Query(s.qry.Filter(s.flt)).Aggregation("aggr", s.outerAggregation()).Do(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		page, err := decodeCompositePage(res, s.aggName, s.pctVal, s.fields())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range page.buckets {
+			results = append(results, b)
+			if maxBuckets > 0 && len(results) >= maxBuckets {
+				return results, nil
+			}
+		}
+
+		if len(page.buckets) < pageSize || page.afterKey == nil {
+			return results, nil
+		}
+		after = page.afterKey
+	}
+}
+
+func (s *searcher) fields() []string {
+	return s.composite.fields
+}
+
+type compositePage struct {
+	buckets  []bucketResult
+	afterKey map[string]interface{}
+}
+
+func decodeCompositePage(res *elastic.SearchResult, aggName string, pctVal string, fields []string) (*compositePage, error) {
+	raw, ok := res.Aggregations["aggr"]
+	if !ok || raw == nil {
+		return &compositePage{}, nil
+	}
+
+	var wrapper struct {
+		AfterKey map[string]interface{} `json:"after_key"`
+		Buckets  []json.RawMessage      `json:"buckets"`
+	}
+	if err := json.Unmarshal(*raw, &wrapper); err != nil {
+		return nil, err
+	}
+
+	page := &compositePage{afterKey: wrapper.AfterKey}
+	for _, b := range wrapper.Buckets {
+		var aggs elastic.Aggregations
+		if err := json.Unmarshal(b, &aggs); err != nil {
+			return nil, err
+		}
+
+		var key map[string]interface{}
+		if raw, ok := aggs["key"]; ok && raw != nil {
+			if err := json.Unmarshal(*raw, &key); err != nil {
+				return nil, err
+			}
+		}
+
+		val, err := metricValue(aggs, aggName, pctVal)
+		if err != nil {
+			return nil, err
+		}
+
+		page.buckets = append(page.buckets, bucketResult{key: compositeKeyLabel(key, fields), value: val})
+	}
+	return page, nil
+}
+
+// handleComposite runs the --bucket-by check: every returned bucket gets its
+// own perfdata line and is checked against warnRange/critRange independently.
+// The overall check status is the worst among all buckets, same as
+// nagiosplugin already resolves for any other multi-AddResult check.
+func handleComposite(check *nagiosplugin.Check, s *searcher) {
+	results, err := s.SearchComposite(*config.maxBuckets)
+	if err != nil {
+		check.AddResult(nagiosplugin.CRITICAL,
+			fmt.Sprintf("Failed to execute search at %v, index %v: %v",
+				*config.elasticsearchURL, *config.index, err))
+		return
+	}
+
+	if len(results) == 0 {
+		res := fmt.Sprintf("%s: 0 composite buckets in search result", *config.desc)
+		switch *config.nullCode {
+		case 0:
+			check.AddResultf(nagiosplugin.OK, res)
+		case 1:
+			check.AddResultf(nagiosplugin.WARNING, res)
+		case 2:
+			check.AddResultf(nagiosplugin.CRITICAL, res)
+		default:
+			check.AddResultf(nagiosplugin.UNKNOWN, res)
+		}
+		return
+	}
+
+	check.AddResultf(nagiosplugin.OK, "%s OK (%d buckets)", *config.desc, len(results))
+
+	for _, b := range results {
+		check.AddPerfDatum(fmt.Sprintf("key=%s", b.key), *config.unit, b.value, 0.0, math.Inf(1), config.floatWarn(), config.floatCrit())
+
+		switch {
+		case critRange.Check(b.value):
+			check.AddResultf(nagiosplugin.CRITICAL, "%s %s=%f%s > %s", *config.desc, b.key, b.value, *config.unit, *config.criticalThreshold+*config.unit)
+		case warnRange.Check(b.value):
+			check.AddResultf(nagiosplugin.WARNING, "%s %s=%f%s > %s", *config.desc, b.key, b.value, *config.unit, *config.warningThreshold+*config.unit)
+		}
+	}
+}
+
+// compositeKeyLabel renders a composite bucket's key as
+// "field1=value1,field2=value2", in the order --bucket-by listed fields.
+func compositeKeyLabel(key map[string]interface{}, fields []string) string {
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		parts = append(parts, fmt.Sprintf("%s=%v", field, key[field]))
+	}
+	return strings.Join(parts, ",")
+}
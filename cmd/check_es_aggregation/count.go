@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+
+	elastic "gopkg.in/olivere/elastic.v5"
+
+	"github.com/olorin/nagiosplugin"
+)
+
+// scrollFilter is --scroll-regex's client-side post-filter, applied to a
+// scroll hit's _source after it comes back, for fields that aren't indexed
+// as keyword and so can't go through the usual AddRegexFilter query.
+type scrollFilter struct {
+	field string
+	re    *regexp.Regexp
+}
+
+// parseScrollFilter parses --scroll-regex's "field:pattern" syntax. An empty
+// spec is valid and means no filter: every scroll hit counts.
+func parseScrollFilter(spec string) (*scrollFilter, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	f := Fields(spec)
+	if len(f) != 2 {
+		return nil, fmt.Errorf("invalid --scroll-regex %q, want field:pattern", spec)
+	}
+	re, err := regexp.Compile(f[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid --scroll-regex pattern: %s", err)
+	}
+	return &scrollFilter{field: f[0], re: re}, nil
+}
+
+// matches reports whether hit's --scroll-regex field matches the filter.
+func (f *scrollFilter) matches(hit *elastic.SearchHit) bool {
+	if hit.Source == nil {
+		return false
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(*hit.Source, &doc); err != nil {
+		return false
+	}
+	val, ok := doc[f.field]
+	if !ok {
+		return false
+	}
+	return f.re.MatchString(fmt.Sprintf("%v", val))
+}
+
+// CountResult runs -a count or -a count_unique, bypassing the metric
+// sub-aggregation entirely: a plain document count via the Count API for
+// "count", or an approximate distinct-value count via a cardinality
+// aggregation for "count_unique".
+func (s *searcher) CountResult() (float64, error) {
+	switch *config.agg {
+	case "count":
+		n, err := s.es.Count(s.idx).Query(s.qry.Filter(s.flt)).Do(context.Background())
+		if err != nil {
+			return float64(0), err
+		}
+		return float64(n), nil
+	case "count_unique":
+		s.attachSubAggregation("aggr_cardinality", elastic.NewCardinalityAggregation().Field(*config.key))
+		if err := s.Search(); err != nil {
+			return float64(0), err
+		}
+		if s.res.TotalHits() == int64(0) {
+			return float64(0), &NoSearchResultError{"0 hits"}
+		}
+		aggr, ok := s.res.Aggregations.DateRange("aggr")
+		if !ok || len(aggr.Buckets) == 0 {
+			return float64(0), &NoSearchResultError{"0 aggregation buckets"}
+		}
+		stat, ok := aggr.Buckets[0].Aggregations.Cardinality("aggr_cardinality")
+		if !ok || stat.Value == nil {
+			return float64(0), &NoAggrValuesError{*config.agg}
+		}
+		return *stat.Value, nil
+	default:
+		return float64(0), fmt.Errorf("unknown count aggregation %q", *config.agg)
+	}
+}
+
+// ScrollResult tallies matching documents by walking every page of a scroll
+// cursor instead of using the Count API, applying filter (if any) to each
+// hit's source along the way. Used by --scroll, for very large result sets
+// or for a --scroll-regex post-filter the Count API can't apply.
+func (s *searcher) ScrollResult(size int, filter *scrollFilter) (float64, error) {
+	svc := s.es.Scroll(s.idx).Query(s.qry.Filter(s.flt)).Size(size)
+	defer svc.Clear(context.Background())
+
+	var total int64
+	for {
+		res, err := svc.Do(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return float64(0), err
+		}
+		if res.Hits == nil {
+			continue
+		}
+		for _, hit := range res.Hits.Hits {
+			if filter == nil || filter.matches(hit) {
+				total++
+			}
+		}
+	}
+
+	return float64(total), nil
+}
+
+// handleCount runs the -a count / -a count_unique check: CountResult's
+// Count API tally or cardinality aggregation, or (with --scroll)
+// ScrollResult's page-by-page tally, instead of Result()'s usual metric
+// aggregation. Mirrors the perfdata/threshold handling at the end of
+// main(), the same way handleComposite does for --bucket-by.
+func handleCount(check *nagiosplugin.Check, s *searcher) {
+	var value float64
+	var err error
+
+	if *config.scroll {
+		var filter *scrollFilter
+		filter, err = parseScrollFilter(*config.scrollRegex)
+		if err == nil {
+			value, err = s.ScrollResult(*config.scrollSize, filter)
+		}
+	} else {
+		value, err = s.CountResult()
+	}
+
+	label := *config.key
+	if label == "" {
+		label = *config.desc
+	}
+
+	check.AddPerfDatum(label, *config.unit, value, 0.0, math.Inf(1), config.floatWarn(), config.floatCrit())
+	if err != nil {
+		res := fmt.Sprintf("%s %f%s (%s)", *config.desc, value, *config.unit, err.Error())
+		switch *config.nullCode {
+		case 0:
+			check.AddResultf(nagiosplugin.OK, res)
+		case 1:
+			check.AddResultf(nagiosplugin.WARNING, res)
+		case 2:
+			check.AddResultf(nagiosplugin.CRITICAL, res)
+		default:
+			check.AddResultf(nagiosplugin.UNKNOWN, res)
+		}
+		return
+	}
+
+	switch {
+	case critRange.Check(value):
+		check.AddResultf(nagiosplugin.CRITICAL, "%s %f%s > %s", *config.desc, value, *config.unit, *config.criticalThreshold+*config.unit)
+	case warnRange.Check(value):
+		check.AddResultf(nagiosplugin.WARNING, "%s %f%s > %s", *config.desc, value, *config.unit, *config.warningThreshold+*config.unit)
+	default:
+		check.AddResultf(nagiosplugin.OK, "%s %f%s", *config.desc, value, *config.unit)
+	}
+}
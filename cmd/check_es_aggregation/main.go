@@ -25,31 +25,51 @@ var (
 )
 
 type args struct {
-	elasticsearchURL  *string
-	debug             *bool
-	query             *string
-	pExists           *[]string
-	nExists           *[]string
-	pTerm             *[]string
-	nTerm             *[]string
-	nMatch            *[]string
-	pMatch            *[]string
-	nPrefix           *[]string
-	pPrefix           *[]string
-	regexp            *[]string
-	pRange            *string
-	nRange            *string
-	index             *string
-	key               *string
-	desc              *string
-	agg               *string
-	pct               *float64
-	unit              *string
-	duration          *time.Duration
-	warningThreshold  *string
-	criticalThreshold *string
-	nullCode          *int
-	verbose           *bool
+	elasticsearchURL    *string
+	retries             *int
+	sniff               *bool
+	healthcheckInterval *time.Duration
+	basicAuth           *string
+	apiKey              *string
+	caCert              *string
+	insecureSkipVerify  *bool
+	simpleClient        *bool
+	debug               *bool
+	query               *string
+	pExists             *[]string
+	nExists             *[]string
+	pTerm               *[]string
+	nTerm               *[]string
+	nMatch              *[]string
+	pMatch              *[]string
+	nPrefix             *[]string
+	pPrefix             *[]string
+	regexp              *[]string
+	pRange              *string
+	nRange              *string
+	index               *string
+	configFile          *string
+	key                 *string
+	desc                *string
+	agg                 *string
+	pct                 *float64
+	bucketBy            *string
+	maxBuckets          *int
+	histogramInterval   *string
+	pipeline            *string
+	pipelineReduce      *string
+	rawQuery            *string
+	rawAggregation      *string
+	resultPath          *string
+	scroll              *bool
+	scrollSize          *int
+	scrollRegex         *string
+	unit                *string
+	duration            *time.Duration
+	warningThreshold    *string
+	criticalThreshold   *string
+	nullCode            *int
+	verbose             *bool
 }
 
 func (a *args) floatCrit() float64 {
@@ -76,24 +96,38 @@ func (a *args) floatWarn() float64 {
  */
 
 type searcher struct {
-	idx     string
-	es      *elastic.Client
-	agg     *elastic.DateRangeAggregation
-	aggName string
-	pctVal  string
-	qry     *elastic.BoolQuery
-	flt     *elastic.BoolQuery
-	res     *elastic.SearchResult
+	idx          string
+	es           *elastic.Client
+	agg          *elastic.DateRangeAggregation
+	histogramAgg *elastic.DateHistogramAggregation
+	aggName      string
+	pctVal       string
+	qry          *elastic.BoolQuery
+	flt          *elastic.BoolQuery
+	res          *elastic.SearchResult
+	composite    *compositeAggregation
+	pipelineKind string
+	pipelineName string
+	rawAgg       elastic.Aggregation
 }
 
-func newSearcher(url string, idx string, timeAgo time.Duration, logger *log.Logger) (*searcher, error) {
-	var err error
-	var client *elastic.Client
-	if logger != nil {
-		client, err = elastic.NewClient(elastic.SetURL(url), elastic.SetTraceLog(logger), elastic.SetSniff(false))
-	} else {
-		client, err = elastic.NewClient(elastic.SetURL(url), elastic.SetSniff(false))
+// newClient builds the Elasticsearch client shared by every searcher, be it
+// the single one the normal CLI flags describe or the several --config
+// creates for a batched _msearch.
+func newClient(cfg *args, logger *log.Logger) (*elastic.Client, error) {
+	opts, err := buildClientOptions(cfg, logger)
+	if err != nil {
+		return nil, err
 	}
+
+	if *cfg.simpleClient {
+		return elastic.NewSimpleClient(opts...)
+	}
+	return elastic.NewClient(opts...)
+}
+
+func newSearcher(cfg *args, idx string, timeAgo time.Duration, logger *log.Logger) (*searcher, error) {
+	client, err := newClient(cfg, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -103,13 +137,61 @@ func newSearcher(url string, idx string, timeAgo time.Duration, logger *log.Logg
 	now := time.Now()
 	from := now.Add(-timeAgo)
 
-	s.agg = elastic.NewDateRangeAggregation().Field("@timestamp").Between(from, now)
 	s.flt = elastic.NewBoolQuery()
 	s.qry = elastic.NewBoolQuery()
 
+	// Every mode bounds the search to the last timeAgo, be it via this
+	// filter alone or (in the default case) also via the date-range bucket
+	// aggregation built below.
+	s.flt = s.flt.Must(elastic.NewRangeQuery("@timestamp").Gte(from).Lte(now))
+
+	switch {
+	case *cfg.rawAggregation != "":
+		// The raw aggregation defines its own bucketing (Aggregate() fills
+		// it in); the filter above is all the bounding it gets.
+	case *cfg.histogramInterval != "":
+		s.histogramAgg = elastic.NewDateHistogramAggregation().Field("@timestamp").Interval(*cfg.histogramInterval)
+	case *cfg.bucketBy != "":
+		// Elasticsearch requires a composite aggregation to be top-level, so
+		// it can't nest under a date-range bucket like the default case;
+		// the filter above bounds the time window instead (see AddCompositeAggregation).
+	default:
+		s.agg = elastic.NewDateRangeAggregation().Field("@timestamp").Between(from, now)
+	}
+
 	return s, nil
 }
 
+// outerAggregation returns the top-level bucketing aggregation the search
+// is built around: the single date-range bucket by default, the composite
+// bucket when --bucket-by is in use, or the date-histogram bucket when
+// --histogram-interval is in use. A --raw-aggregation body takes precedence
+// over all of these.
+func (s *searcher) outerAggregation() elastic.Aggregation {
+	if s.rawAgg != nil {
+		return s.rawAgg
+	}
+	if s.composite != nil {
+		return s.composite
+	}
+	if s.histogramAgg != nil {
+		return s.histogramAgg
+	}
+	return s.agg
+}
+
+// attachSubAggregation nests agg under the date-histogram bucket when
+// --histogram-interval is in use, otherwise under the date-range bucket.
+// It does not handle the composite or raw aggregations: the composite one
+// gets its sub-aggregation from AddCompositeAggregation.
+func (s *searcher) attachSubAggregation(name string, agg elastic.Aggregation) {
+	if s.histogramAgg != nil {
+		s.histogramAgg = s.histogramAgg.SubAggregation(name, agg)
+		return
+	}
+	s.agg = s.agg.SubAggregation(name, agg)
+}
+
 func (s *searcher) AddQueryString(str string) *searcher {
 	s.qry = s.qry.Must(elastic.NewQueryStringQuery(str))
 	return s
@@ -182,7 +264,12 @@ func (s *searcher) AddRangeFilter(field string, rng string, negative bool) *sear
 	return s
 }
 
-func (s *searcher) AddSubAggregation(field string, name string, params ...interface{}) *searcher {
+// buildMetricAggregation builds the metric aggregation used for "-a", be it
+// plugged directly under the date-range or date-histogram bucket
+// (AddSubAggregation) or nested
+// inside a composite bucket (AddCompositeAggregation). It returns nil if
+// name isn't a known aggregation.
+func (s *searcher) buildMetricAggregation(field string, name string, params ...interface{}) (elastic.Aggregation, string) {
 	var agg elastic.Aggregation
 
 	switch name {
@@ -205,98 +292,137 @@ func (s *searcher) AddSubAggregation(field string, name string, params ...interf
 	case "stdev", "stdevmin", "stdevmax", "var":
 		agg = elastic.NewExtendedStatsAggregation().Field(field)
 	default:
+		return nil, ""
+	}
+
+	return agg, name + "_" + field
+}
+
+func (s *searcher) AddSubAggregation(field string, name string, params ...interface{}) *searcher {
+	agg, aggName := s.buildMetricAggregation(field, name, params...)
+	if agg == nil {
 		return s
 	}
 
-	s.aggName = name + "_" + field
-	s.agg = s.agg.SubAggregation(s.aggName, agg)
+	s.aggName = aggName
+	s.attachSubAggregation(s.aggName, agg)
 
 	return s
 }
 
-func (s *searcher) Result() (float64, error) {
-	if s.res.TotalHits() == int64(0) {
-		return float64(0), &NoSearchResultError{"0 hits"}
-	}
-	aggr, ok := s.res.Aggregations.DateRange("aggr")
-	if !ok {
-		return float64(0), &NoSearchResultError{"no aggregations"}
-	}
-	if len(aggr.Buckets) == 0 {
-		return float64(0), &NoSearchResultError{"0 aggregation buckets"}
-	}
-	var val float64
-	switch *config.agg {
+// metricValue extracts the value of the aggregation chosen by -a/--aggregation
+// from a set of aggregation results. It's shared by the single-bucket Result()
+// and the per-bucket composite-aggregation path.
+func metricValue(aggr elastic.Aggregations, aggName string, pctVal string) (float64, error) {
+	return metricValueNamed(aggr, aggName, pctVal, *config.agg)
+}
+
+// metricValueNamed is metricValue with the aggregation kind passed in
+// explicitly instead of read from the global -a/--aggregation flag, so
+// --config's per-check aggregation choice (see RunConfig) can reuse it too.
+func metricValueNamed(aggr elastic.Aggregations, aggName string, pctVal string, aggKind string) (float64, error) {
+	switch aggKind {
 	case "min":
-		stat, ok := aggr.Buckets[0].Min(s.aggName)
+		stat, ok := aggr.Min(aggName)
 		if !ok {
-			return float64(0), &NoAggrValuesError{*config.agg}
+			return float64(0), &NoAggrValuesError{aggKind}
 		}
-		val = *stat.Value
+		return *stat.Value, nil
 	case "max":
-		stat, ok := aggr.Buckets[0].Max(s.aggName)
+		stat, ok := aggr.Max(aggName)
 		if !ok {
-			return float64(0), &NoAggrValuesError{*config.agg}
+			return float64(0), &NoAggrValuesError{aggKind}
 		}
-		val = *stat.Value
+		return *stat.Value, nil
 	case "avg":
-		stat, ok := aggr.Buckets[0].Avg(s.aggName)
+		stat, ok := aggr.Avg(aggName)
 		if !ok {
-			return float64(0), &NoAggrValuesError{*config.agg}
+			return float64(0), &NoAggrValuesError{aggKind}
 		}
-		val = *stat.Value
+		return *stat.Value, nil
 	case "sum":
-		stat, ok := aggr.Buckets[0].Sum(s.aggName)
+		stat, ok := aggr.Sum(aggName)
 		if !ok {
-			return float64(0), &NoAggrValuesError{*config.agg}
+			return float64(0), &NoAggrValuesError{aggKind}
 		}
-		val = *stat.Value
+		return *stat.Value, nil
 	case "pct":
-		stat, ok := aggr.Buckets[0].Percentiles(s.aggName)
+		stat, ok := aggr.Percentiles(aggName)
 		if !ok {
-			return float64(0), &NoAggrValuesError{*config.agg}
+			return float64(0), &NoAggrValuesError{aggKind}
 		}
-		val = stat.Values[s.pctVal]
+		return stat.Values[pctVal], nil
 	case "pctr":
-		stat, ok := aggr.Buckets[0].PercentileRanks(s.aggName)
+		stat, ok := aggr.PercentileRanks(aggName)
 		if !ok {
-			return float64(0), &NoAggrValuesError{*config.agg}
+			return float64(0), &NoAggrValuesError{aggKind}
 		}
-		val = stat.Values[s.pctVal]
+		return stat.Values[pctVal], nil
 	case "stdev":
-		stat, ok := aggr.Buckets[0].ExtendedStats(s.aggName)
+		stat, ok := aggr.ExtendedStats(aggName)
 		if !ok {
-			return float64(0), &NoAggrValuesError{*config.agg}
+			return float64(0), &NoAggrValuesError{aggKind}
 		}
-		val = *stat.StdDeviation
+		return *stat.StdDeviation, nil
 	case "stdevmin":
-		stat, ok := aggr.Buckets[0].ExtendedStats(s.aggName)
+		stat, ok := aggr.ExtendedStats(aggName)
 		if !ok {
-			return float64(0), &NoAggrValuesError{*config.agg}
+			return float64(0), &NoAggrValuesError{aggKind}
 		}
-		val = *stat.Min
+		return *stat.Min, nil
 	case "stdevmax":
-		stat, ok := aggr.Buckets[0].ExtendedStats(s.aggName)
+		stat, ok := aggr.ExtendedStats(aggName)
 		if !ok {
-			return float64(0), &NoAggrValuesError{*config.agg}
+			return float64(0), &NoAggrValuesError{aggKind}
 		}
-		val = *stat.Max
+		return *stat.Max, nil
 	case "var":
-		stat, ok := aggr.Buckets[0].ExtendedStats(s.aggName)
+		stat, ok := aggr.ExtendedStats(aggName)
 		if !ok {
-			return float64(0), &NoAggrValuesError{*config.agg}
+			return float64(0), &NoAggrValuesError{aggKind}
 		}
-		val = *stat.Variance
+		return *stat.Variance, nil
 	default:
-		return float64(0), &NoAggrValuesError{*config.agg}
+		return float64(0), &NoAggrValuesError{aggKind}
+	}
+}
+
+func (s *searcher) Result() (float64, error) {
+	if s.res.TotalHits() == int64(0) {
+		return float64(0), &NoSearchResultError{"0 hits"}
+	}
+	aggr, ok := s.res.Aggregations.DateRange("aggr")
+	if !ok {
+		return float64(0), &NoSearchResultError{"no aggregations"}
 	}
-	return val, nil
+	if len(aggr.Buckets) == 0 {
+		return float64(0), &NoSearchResultError{"0 aggregation buckets"}
+	}
+	return metricValue(aggr.Buckets[0].Aggregations, s.aggName, s.pctVal)
 }
 
 func (s *searcher) Search() error {
-	var err error
-	s.res, err = s.es.Search(s.idx).Query(s.qry.Filter(s.flt)).Aggregation("aggr", s.agg).Do(context.Background())
-	return err
+	res, err := s.es.Search(s.idx).Query(s.qry.Filter(s.flt)).Aggregation("aggr", s.outerAggregation()).Do(context.Background())
+	if err != nil {
+		return err
+	}
+	s.SetResult(res)
+	return nil
+}
+
+// SetResult lets Result() (and RunConfig's metricValue) work off a
+// *elastic.SearchResult that came from somewhere other than Search(), such
+// as one of the responses in a batched _msearch.
+func (s *searcher) SetResult(res *elastic.SearchResult) {
+	s.res = res
+}
+
+// SearchRequest builds this searcher's query and aggregation as an
+// *elastic.SearchRequest, so --config can batch several of them into one
+// elastic.Client.MultiSearch() round-trip.
+func (s *searcher) SearchRequest() *elastic.SearchRequest {
+	source := elastic.NewSearchSource().Query(s.qry.Filter(s.flt)).Aggregation("aggr", s.outerAggregation())
+	return elastic.NewSearchRequest().Index(s.idx).Source(source)
 }
 
 // ----------------------------------------------------------------------------------
@@ -393,16 +519,42 @@ func Filter(s *searcher) {
 	}
 }
 
-func Query(s *searcher) {
+func Query(s *searcher) error {
+	if *config.rawQuery != "" {
+		return s.AddRawQuery(*config.rawQuery)
+	}
 	s.AddQueryString(*config.query)
+	return nil
 }
 
-func Aggregate(s *searcher) {
+func Aggregate(s *searcher) error {
+	if *config.rawAggregation != "" {
+		return s.AddRawAggregation(*config.rawAggregation)
+	}
+
+	if *config.agg == "count" || *config.agg == "count_unique" {
+		// CountResult/ScrollResult build their own request; see handleCount.
+		return nil
+	}
+
 	var params interface{}
 	if *config.agg == "pct" {
 		params = *config.pct
 	}
+
+	if *config.bucketBy != "" {
+		s.AddCompositeAggregation(strings.Split(*config.bucketBy, ","), *config.key, *config.agg, params)
+		return nil
+	}
+
 	s.AddSubAggregation(*config.key, *config.agg, params)
+
+	if *config.pipeline != "" {
+		_, err := s.AddPipelineAggregation(*config.pipeline)
+		return err
+	}
+
+	return nil
 }
 
 // ----------------------------------------------------------------------------------
@@ -425,6 +577,8 @@ Supported aggregations:
   stdevmin     Standard deviation lower boundary
   stdevmax     Standard deviation upper boundary
   var          Variance
+  count        Document count via the Count API, no -k/--key required
+  count_unique Approximate distinct count of -k/--key's values (cardinality aggregation)
 
 Supported filters:
   (not-)exists    Matches against field presence
@@ -460,10 +614,19 @@ Notes:
 `
 
 	params := kingpin.New("check-es-aggregation", "Nagios Plugin to compute ElasticSearch aggregations").UsageTemplate(template)
-	config.elasticsearchURL = params.Flag("es-url", "Elasticsearch URL.").Default("http://localhost:9200").String()
+	config.elasticsearchURL = params.Flag("es-url", "Elasticsearch URL(s). Comma-separate multiple cluster nodes.").Default("http://localhost:9200").String()
+	config.retries = params.Flag("retries", "Number of retries for failed Elasticsearch requests").Default("0").Int()
+	config.sniff = params.Flag("sniff", "Enable sniffing to discover all nodes in the cluster").Default("false").Bool()
+	config.healthcheckInterval = params.Flag("healthcheck-interval", "Interval between node healthchecks (0 disables periodic healthchecks)").Default("0s").Duration()
+	config.basicAuth = params.Flag("basic-auth", "HTTP basic auth credentials, given as user:pass").String()
+	config.apiKey = params.Flag("api-key", "Elasticsearch API key to authenticate with").String()
+	config.caCert = params.Flag("ca-cert", "Path to a PEM-encoded CA certificate used to verify the Elasticsearch server").String()
+	config.insecureSkipVerify = params.Flag("insecure-skip-verify", "Skip TLS certificate verification").Bool()
+	config.simpleClient = params.Flag("simple-client", "Use a simple client that skips connection-pool sniffing and healthchecks").Bool()
 	config.debug = params.Flag("debug", "Enable logging of HTTP requests to STDERR").Bool()
 	config.index = params.Flag("index-pattern", "Elasticsearch index pattern, eg. logstash-*").Default("logstash-*").String()
-	config.key = params.Flag("key", "Elasticsearch document key to aggregate (check result will be based on the value of this field)").Short('k').Required().String()
+	config.configFile = params.Flag("config", "Run N named checks described by this YAML/JSON file in a single _msearch round-trip, instead of the single check described by the other flags").PlaceHolder("file|-").String()
+	config.key = params.Flag("key", "Elasticsearch document key to aggregate (check result will be based on the value of this field)").Short('k').String()
 	config.query = params.Flag("query", "Elasticsearch query string").Short('q').Default("*").String()
 	config.pExists = params.Flag("exists", "Elasticsearch exists filter").Short('e').Strings()
 	config.nExists = params.Flag("not-exists", "Elasticsearch missing filter").Strings()
@@ -478,11 +641,22 @@ Notes:
 	config.nRange = params.Flag("not-range", "Elasticsearch value negative range filter").String()
 	config.agg = params.Flag("aggregation", "Elasticsearch aggregation to compute").Short('a').Default("max").String()
 	config.pct = params.Flag("percentile", "Elasticsearch percentile aggregations parameter").Default("99.0").Float64()
+	config.bucketBy = params.Flag("bucket-by", "Comma-separated field(s) to bucket the aggregation by (composite aggregation mode); thresholds are then applied per bucket").String()
+	config.maxBuckets = params.Flag("max-buckets", "Maximum number of composite buckets to report in --bucket-by mode").Default("100").Int()
+	config.histogramInterval = params.Flag("histogram-interval", "Bucket the time range into a date histogram at this interval (e.g. 1m) instead of a single bucket, so a --pipeline trend can be computed across it").String()
+	config.pipeline = params.Flag("pipeline", "Pipeline aggregation computed across --histogram-interval buckets").Enum("derivative", "moving_avg", "serial_diff", "cumulative_sum")
+	config.pipelineReduce = params.Flag("pipeline-reduce", "How to reduce --pipeline's per-bucket values into the value that gets thresholded").Default("last").Enum("last", "max", "mean")
+	config.rawQuery = params.Flag("raw-query", "Read a raw Elasticsearch query body from this file (or - for stdin), used instead of -q/--query").PlaceHolder("file|-").String()
+	config.rawAggregation = params.Flag("raw-aggregation", "Read a raw Elasticsearch aggregation body from this file (or - for stdin), used instead of -a/--aggregation").PlaceHolder("file|-").String()
+	config.resultPath = params.Flag("result-path", "Dotted path into the search response's aggregations to threshold, e.g. aggr.my_bucket.value (requires --raw-aggregation)").String()
+	config.scroll = params.Flag("scroll", "Tally matching documents via the Scroll API instead of the Count API (requires -a count; needed for --scroll-regex or very large result sets)").Bool()
+	config.scrollSize = params.Flag("scroll-size", "Page size per request in --scroll mode").Default("1000").Int()
+	config.scrollRegex = params.Flag("scroll-regex", "Client-side regex post-filter applied to each --scroll hit, for fields that aren't indexed as keyword").PlaceHolder("field:pattern").String()
 	config.unit = params.Flag("unit", "Unit displayed in the check description").Short('u').Default("").String()
 	config.desc = params.Flag("desc", "Check description").Short('d').String()
 	config.duration = params.Flag("duration", "Time range to perform the search on.").Default("5m").Duration()
-	config.warningThreshold = params.Flag("warning", "Warning threshold number").Short('w').Required().String()
-	config.criticalThreshold = params.Flag("critical", "Critical threshold number").Short('c').Required().String()
+	config.warningThreshold = params.Flag("warning", "Warning threshold number").Short('w').String()
+	config.criticalThreshold = params.Flag("critical", "Critical threshold number").Short('c').String()
 	config.nullCode = params.Flag("null-code", "zero search results fallback code").Short('n').Default("2").Int()
 	config.verbose = params.Flag("verbose", "Increase verbosity for debugging").Bool()
 
@@ -490,25 +664,57 @@ Notes:
 
 	var argsInvalid bool
 
-	if *config.key == "" {
-		fmt.Println(&ArgumentMissingError{"-k"})
+	if *config.configFile == "" {
+		if *config.key == "" && *config.agg != "count" {
+			fmt.Println(&ArgumentMissingError{"-k"})
+			argsInvalid = true
+		}
+
+		warnRange, err = validateTreshold(config.warningThreshold, "-w")
+		if err != nil {
+			fmt.Println(err)
+			argsInvalid = true
+		}
+
+		critRange, err = validateTreshold(config.criticalThreshold, "-c")
+		if err != nil {
+			fmt.Println(err)
+			argsInvalid = true
+		}
+	}
+
+	if *config.index == "" || *config.index == "*" {
+		fmt.Printf("Invalid ES index '%s' given\n", *config.index)
 		argsInvalid = true
 	}
 
-	warnRange, err = validateTreshold(config.warningThreshold, "-w")
-	if err != nil {
-		fmt.Println(err)
+	if *config.pipeline != "" && *config.histogramInterval == "" {
+		fmt.Println("--pipeline requires --histogram-interval")
 		argsInvalid = true
 	}
 
-	critRange, err = validateTreshold(config.criticalThreshold, "-c")
-	if err != nil {
-		fmt.Println(err)
+	if *config.histogramInterval != "" && *config.pipeline == "" {
+		fmt.Println("--histogram-interval requires --pipeline")
 		argsInvalid = true
 	}
 
-	if *config.index == "" || *config.index == "*" {
-		fmt.Printf("Invalid ES index '%s' given\n", *config.index)
+	if *config.resultPath != "" && *config.rawAggregation == "" {
+		fmt.Println("--result-path requires --raw-aggregation")
+		argsInvalid = true
+	}
+
+	if *config.bucketBy != "" && (*config.agg == "count" || *config.agg == "count_unique") {
+		fmt.Println("--bucket-by is not supported with -a count/count_unique")
+		argsInvalid = true
+	}
+
+	if *config.scroll && *config.agg != "count" {
+		fmt.Println("--scroll requires -a count")
+		argsInvalid = true
+	}
+
+	if *config.scrollRegex != "" && !*config.scroll {
+		fmt.Println("--scroll-regex requires --scroll")
 		argsInvalid = true
 	}
 
@@ -517,7 +723,12 @@ Notes:
 	}
 
 	if *config.desc == "" {
-		config.desc = config.key
+		if *config.key != "" {
+			config.desc = config.key
+		} else {
+			agg := *config.agg
+			config.desc = &agg
+		}
 	}
 
 	if *config.debug {
@@ -531,17 +742,38 @@ func main() {
 	check := nagiosplugin.NewCheck()
 	defer check.Finish() // If exit early or panic, still output a result.
 
+	if *config.configFile != "" {
+		RunConfig(check, *config.configFile)
+		return
+	}
+
 	// initialize searcher
-	searcher, err := newSearcher(*config.elasticsearchURL, *config.index, *config.duration, logger)
+	searcher, err := newSearcher(config, *config.index, *config.duration, logger)
 	if err != nil {
 		check.AddResult(nagiosplugin.CRITICAL,
 			fmt.Sprintf("Failed to connect to %v: %v", *config.elasticsearchURL, err))
 		return
 	}
 
-	Query(searcher)
+	if err := Query(searcher); err != nil {
+		check.AddResult(nagiosplugin.UNKNOWN, fmt.Sprintf("Invalid query configuration: %v", err))
+		return
+	}
 	Filter(searcher)
-	Aggregate(searcher)
+	if err := Aggregate(searcher); err != nil {
+		check.AddResult(nagiosplugin.UNKNOWN, fmt.Sprintf("Invalid aggregation configuration: %v", err))
+		return
+	}
+
+	if *config.bucketBy != "" {
+		handleComposite(check, searcher)
+		return
+	}
+
+	if *config.agg == "count" || *config.agg == "count_unique" {
+		handleCount(check, searcher)
+		return
+	}
 
 	// do the search
 	err = searcher.Search()
@@ -553,7 +785,15 @@ func main() {
 	}
 
 	// handle the result
-	value, err := searcher.Result()
+	var value float64
+	switch {
+	case *config.resultPath != "":
+		value, err = searcher.RawResult(*config.resultPath)
+	case *config.pipeline != "":
+		value, err = searcher.PipelineResult(*config.pipelineReduce)
+	default:
+		value, err = searcher.Result()
+	}
 	check.AddPerfDatum(*config.key, *config.unit, value, 0.0, math.Inf(1), config.floatWarn(), config.floatCrit())
 	if err != nil {
 		res := fmt.Sprintf("%s %f%s (%s)", *config.desc, value, *config.unit, err.Error())
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v5"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/olorin/nagiosplugin"
+)
+
+// checkFilter is one entry of a checkConfig's filters list, the --config
+// equivalent of the (not-)exists/(not-)term/(not-)match/(not-)prefix/regex/
+// (not-)range CLI flags.
+type checkFilter struct {
+	Type   string `yaml:"type"`
+	Field  string `yaml:"field"`
+	Value  string `yaml:"value"`
+	Negate bool   `yaml:"negate"`
+}
+
+// checkConfig is one named check in a --config file. It mirrors the fields
+// that, for a single check, would otherwise come from -q/filters/-k/-a/
+// --percentile/-w/-c/-d/-u/--duration.
+type checkConfig struct {
+	Name        string        `yaml:"name"`
+	Query       string        `yaml:"query"`
+	Filters     []checkFilter `yaml:"filters"`
+	Key         string        `yaml:"key"`
+	Aggregation string        `yaml:"aggregation"`
+	Percentile  float64       `yaml:"percentile"`
+	Warning     string        `yaml:"warning"`
+	Critical    string        `yaml:"critical"`
+	Desc        string        `yaml:"desc"`
+	Unit        string        `yaml:"unit"`
+	Duration    string        `yaml:"duration"`
+}
+
+// loadCheckConfigs reads --config's file (or stdin, for "-"). yaml.v3 parses
+// JSON too, since JSON is a syntactic subset of YAML, so a single file
+// format covers both without sniffing an extension.
+func loadCheckConfigs(path string) ([]checkConfig, error) {
+	data, err := readInput(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading --config: %s", err)
+	}
+
+	var checks []checkConfig
+	if err := yaml.Unmarshal(data, &checks); err != nil {
+		return nil, fmt.Errorf("parsing --config: %s", err)
+	}
+	if len(checks) == 0 {
+		return nil, fmt.Errorf("--config defines no checks")
+	}
+
+	return checks, nil
+}
+
+// checkSearch bundles one --config entry's searcher with the warning/
+// critical ranges and label it's checked against, since those no longer
+// come from the global config/warnRange/critRange once there's more than
+// one check in play.
+type checkSearch struct {
+	cfg       checkConfig
+	s         *searcher
+	warnRange *nagiosplugin.Range
+	critRange *nagiosplugin.Range
+	warnFloat float64
+	critFloat float64
+}
+
+// newConfigSearcher builds the searcher for a single --config entry,
+// sharing the already-connected client so every check's query is part of
+// the same _msearch round-trip.
+func newConfigSearcher(client *elastic.Client, idx string, defaultDuration time.Duration, c checkConfig) (*searcher, error) {
+	timeAgo := defaultDuration
+	if c.Duration != "" {
+		d, err := time.ParseDuration(c.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("check %q: invalid duration %q: %s", c.Name, c.Duration, err)
+		}
+		timeAgo = d
+	}
+
+	now := time.Now()
+	from := now.Add(-timeAgo)
+
+	s := &searcher{
+		es:  client,
+		idx: idx,
+		qry: elastic.NewBoolQuery(),
+		flt: elastic.NewBoolQuery(),
+		agg: elastic.NewDateRangeAggregation().Field("@timestamp").Between(from, now),
+	}
+
+	if c.Query != "" {
+		s.AddQueryString(c.Query)
+	}
+	for _, f := range c.Filters {
+		if err := applyCheckFilter(s, f); err != nil {
+			return nil, fmt.Errorf("check %q: %s", c.Name, err)
+		}
+	}
+
+	var params interface{}
+	if c.Aggregation == "pct" || c.Aggregation == "pctr" {
+		params = c.Percentile
+	}
+	s.AddSubAggregation(c.Key, c.Aggregation, params)
+	if s.aggName == "" {
+		return nil, fmt.Errorf("check %q: unknown aggregation %q", c.Name, c.Aggregation)
+	}
+
+	return s, nil
+}
+
+// applyCheckFilter is --config's equivalent of Filter()'s per-flag loops,
+// dispatching on the filter's type instead of which flag it came from.
+func applyCheckFilter(s *searcher, f checkFilter) error {
+	switch f.Type {
+	case "exists":
+		s.AddExistsFilter(f.Field, f.Negate)
+	case "term":
+		s.AddTermFilter(f.Field, f.Value, f.Negate)
+	case "match":
+		s.AddMatchFilter(f.Field, f.Value, f.Negate)
+	case "prefix":
+		s.AddPrefixFilter(f.Field, f.Value, f.Negate)
+	case "regex":
+		s.AddRegexFilter(f.Field, f.Value)
+	case "range":
+		s.AddRangeFilter(f.Field, f.Value, f.Negate)
+	default:
+		return fmt.Errorf("unknown filter type %q", f.Type)
+	}
+	return nil
+}
+
+// metricValue reads checkSearch's own aggregation choice out of a search
+// result, the --config counterpart of Result(), which instead reads the
+// global -a/--aggregation.
+func (cs *checkSearch) metricValue() (float64, error) {
+	if cs.s.res.TotalHits() == int64(0) {
+		return float64(0), &NoSearchResultError{"0 hits"}
+	}
+	aggr, ok := cs.s.res.Aggregations.DateRange("aggr")
+	if !ok || len(aggr.Buckets) == 0 {
+		return float64(0), &NoSearchResultError{"0 aggregation buckets"}
+	}
+	return metricValueNamed(aggr.Buckets[0].Aggregations, cs.s.aggName, cs.s.pctVal, cs.cfg.Aggregation)
+}
+
+// RunConfig runs every check described by --config as a single _msearch
+// round-trip and folds each one's outcome into check, Nagios-style: the
+// overall exit status ends up the worst among all of them, same as
+// handleComposite's per-bucket results do.
+func RunConfig(check *nagiosplugin.Check, path string) {
+	configs, err := loadCheckConfigs(path)
+	if err != nil {
+		check.AddResult(nagiosplugin.UNKNOWN, fmt.Sprintf("Invalid --config: %v", err))
+		return
+	}
+
+	client, err := newClient(config, logger)
+	if err != nil {
+		check.AddResult(nagiosplugin.CRITICAL,
+			fmt.Sprintf("Failed to connect to %v: %v", *config.elasticsearchURL, err))
+		return
+	}
+
+	checks := make([]*checkSearch, 0, len(configs))
+	requests := make([]*elastic.SearchRequest, 0, len(configs))
+	for _, c := range configs {
+		s, err := newConfigSearcher(client, *config.index, *config.duration, c)
+		if err != nil {
+			check.AddResult(nagiosplugin.UNKNOWN, fmt.Sprintf("Invalid --config: %v", err))
+			return
+		}
+
+		warnRange, err := validateTreshold(&c.Warning, fmt.Sprintf("check %q warning", c.Name))
+		if err != nil {
+			check.AddResult(nagiosplugin.UNKNOWN, err.Error())
+			return
+		}
+		critRange, err := validateTreshold(&c.Critical, fmt.Sprintf("check %q critical", c.Name))
+		if err != nil {
+			check.AddResult(nagiosplugin.UNKNOWN, err.Error())
+			return
+		}
+
+		warnFloat, err := strconv.ParseFloat(c.Warning, 64)
+		if err != nil {
+			check.AddResult(nagiosplugin.UNKNOWN, fmt.Sprintf("check %q: invalid warning threshold %q: %s", c.Name, c.Warning, err))
+			return
+		}
+		critFloat, err := strconv.ParseFloat(c.Critical, 64)
+		if err != nil {
+			check.AddResult(nagiosplugin.UNKNOWN, fmt.Sprintf("check %q: invalid critical threshold %q: %s", c.Name, c.Critical, err))
+			return
+		}
+
+		checks = append(checks, &checkSearch{
+			cfg: c, s: s,
+			warnRange: warnRange, critRange: critRange,
+			warnFloat: warnFloat, critFloat: critFloat,
+		})
+		requests = append(requests, s.SearchRequest())
+	}
+
+	result, err := client.MultiSearch().Add(requests...).Do(context.Background())
+	if err != nil {
+		check.AddResult(nagiosplugin.CRITICAL,
+			fmt.Sprintf("Failed to execute _msearch at %v, index %v: %v",
+				*config.elasticsearchURL, *config.index, err))
+		return
+	}
+
+	if len(result.Responses) != len(checks) {
+		check.AddResult(nagiosplugin.UNKNOWN, "_msearch returned a different number of responses than checks requested")
+		return
+	}
+
+	for i, cs := range checks {
+		label := cs.cfg.Name
+		if label == "" {
+			label = cs.cfg.Key
+		}
+		desc := cs.cfg.Desc
+		if desc == "" {
+			desc = label
+		}
+
+		cs.s.SetResult(result.Responses[i])
+		value, err := cs.metricValue()
+		check.AddPerfDatum(label, cs.cfg.Unit, value, 0.0, math.Inf(1), cs.warnFloat, cs.critFloat)
+		if err != nil {
+			check.AddResultf(nagiosplugin.UNKNOWN, "%s %f%s (%s)", desc, value, cs.cfg.Unit, err.Error())
+			continue
+		}
+
+		switch {
+		case cs.critRange.Check(value):
+			check.AddResultf(nagiosplugin.CRITICAL, "%s %s=%f%s > %s", desc, label, value, cs.cfg.Unit, cs.cfg.Critical)
+		case cs.warnRange.Check(value):
+			check.AddResultf(nagiosplugin.WARNING, "%s %s=%f%s > %s", desc, label, value, cs.cfg.Unit, cs.cfg.Warning)
+		default:
+			check.AddResultf(nagiosplugin.OK, "%s %s=%f%s", desc, label, value, cs.cfg.Unit)
+		}
+	}
+}
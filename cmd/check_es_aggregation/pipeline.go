@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// buildPipelineAggregation builds the pipeline aggregation selected by
+// --pipeline, referencing the metric sub-aggregation (bucketsPath) it
+// should compute its trend over.
+func buildPipelineAggregation(kind string, bucketsPath string) (elastic.Aggregation, error) {
+	switch kind {
+	case "derivative":
+		return elastic.NewDerivativeAggregation().BucketsPath(bucketsPath), nil
+	case "moving_avg":
+		return elastic.NewMovAvgAggregation().BucketsPath(bucketsPath), nil
+	case "serial_diff":
+		return elastic.NewSerialDiffAggregation().BucketsPath(bucketsPath), nil
+	case "cumulative_sum":
+		return elastic.NewCumulativeSumAggregation().BucketsPath(bucketsPath), nil
+	default:
+		return nil, fmt.Errorf("unknown --pipeline %q", kind)
+	}
+}
+
+// pipelineValue reads a pipeline aggregation's value out of a histogram
+// bucket's aggregation results. Buckets near the start of a derivative or
+// serial_diff series legitimately have no value, which callers treat as
+// "skip this bucket" rather than an error.
+func pipelineValue(aggr elastic.Aggregations, kind string, name string) (float64, bool) {
+	switch kind {
+	case "derivative":
+		stat, ok := aggr.Derivative(name)
+		if !ok || stat.Value == nil {
+			return 0, false
+		}
+		return *stat.Value, true
+	case "moving_avg":
+		stat, ok := aggr.MovAvg(name)
+		if !ok || stat.Value == nil {
+			return 0, false
+		}
+		return *stat.Value, true
+	case "serial_diff":
+		stat, ok := aggr.SerialDiff(name)
+		if !ok || stat.Value == nil {
+			return 0, false
+		}
+		return *stat.Value, true
+	case "cumulative_sum":
+		stat, ok := aggr.CumulativeSum(name)
+		if !ok || stat.Value == nil {
+			return 0, false
+		}
+		return *stat.Value, true
+	default:
+		return 0, false
+	}
+}
+
+// AddPipelineAggregation attaches a pipeline aggregation alongside the
+// metric sub-aggregation already set up by AddSubAggregation. It's a no-op
+// if no metric aggregation has been configured yet.
+func (s *searcher) AddPipelineAggregation(kind string) (*searcher, error) {
+	if s.aggName == "" {
+		return s, nil
+	}
+
+	bucketsPath := s.aggName
+	if s.pctVal != "" {
+		// pct/pctr are multi-value metrics; ES needs the specific value
+		// picked out of them, e.g. "pct_field[99.0]".
+		bucketsPath = fmt.Sprintf("%s[%s]", s.aggName, s.pctVal)
+	}
+
+	agg, err := buildPipelineAggregation(kind, bucketsPath)
+	if err != nil {
+		return s, err
+	}
+
+	s.pipelineKind = kind
+	s.pipelineName = "pipeline_" + kind
+	s.attachSubAggregation(s.pipelineName, agg)
+
+	return s, nil
+}
+
+// PipelineResult reduces the pipeline aggregation's per-bucket values,
+// computed across the --histogram-interval buckets, down to a single float
+// to threshold, as selected by --pipeline-reduce.
+func (s *searcher) PipelineResult(reduce string) (float64, error) {
+	if s.res.TotalHits() == int64(0) {
+		return float64(0), &NoSearchResultError{"0 hits"}
+	}
+
+	hist, ok := s.res.Aggregations.DateHistogram("aggr")
+	if !ok || len(hist.Buckets) == 0 {
+		return float64(0), &NoSearchResultError{"0 histogram buckets"}
+	}
+
+	var values []float64
+	for _, bucket := range hist.Buckets {
+		if v, ok := pipelineValue(bucket.Aggregations, s.pipelineKind, s.pipelineName); ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return float64(0), &NoAggrValuesError{s.pipelineKind}
+	}
+
+	switch reduce {
+	case "last":
+		return values[len(values)-1], nil
+	case "max":
+		max := values[0]
+		for _, v := range values[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return max, nil
+	case "mean":
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values)), nil
+	default:
+		return float64(0), fmt.Errorf("unknown --pipeline-reduce %q", reduce)
+	}
+}
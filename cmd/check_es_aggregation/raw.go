@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// readInput reads a whole file, or stdin when path is "-". Used by
+// --raw-query, --raw-aggregation and --config.
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// rawAggregation is a custom elastic.Aggregation whose Source() is whatever
+// JSON came from --raw-aggregation, verbatim. This is the same technique
+// esquery's CustomAgg uses: Aggregation only requires a Source() method, so
+// any aggregation Elasticsearch understands can be used even without a
+// typed builder for it in this version of the client.
+type rawAggregation struct {
+	body map[string]interface{}
+}
+
+func (r rawAggregation) Source() (interface{}, error) {
+	return r.body, nil
+}
+
+// AddRawQuery reads a raw Elasticsearch query body from path (or stdin, for
+// "-") and ANDs it into the search, replacing the -q/--query string.
+func (s *searcher) AddRawQuery(path string) error {
+	data, err := readInput(path)
+	if err != nil {
+		return fmt.Errorf("reading --raw-query: %s", err)
+	}
+	s.qry = s.qry.Must(elastic.NewRawStringQuery(string(data)))
+	return nil
+}
+
+// AddRawAggregation reads a raw aggregation body from path (or stdin) and
+// uses it as the top-level "aggr" aggregation, replacing the normal
+// date-range/date-histogram + metric aggregation built by Aggregate().
+func (s *searcher) AddRawAggregation(path string) error {
+	data, err := readInput(path)
+	if err != nil {
+		return fmt.Errorf("reading --raw-aggregation: %s", err)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return fmt.Errorf("parsing --raw-aggregation: %s", err)
+	}
+	s.rawAgg = rawAggregation{body: body}
+	return nil
+}
+
+// RawResult walks --result-path (e.g. "aggr.my_bucket.value") against the
+// raw search response aggregations and returns the float found there.
+func (s *searcher) RawResult(path string) (float64, error) {
+	if s.res.TotalHits() == int64(0) {
+		return float64(0), &NoSearchResultError{"0 hits"}
+	}
+	return walkResultPath(s.res.Aggregations, path)
+}
+
+func walkResultPath(aggs elastic.Aggregations, path string) (float64, error) {
+	segments := splitResultPath(path)
+	if len(segments) == 0 {
+		return float64(0), fmt.Errorf("empty --result-path")
+	}
+
+	raw, ok := aggs[segments[0]]
+	if !ok || raw == nil {
+		return float64(0), fmt.Errorf("no %q aggregation in search response", segments[0])
+	}
+
+	var cur interface{}
+	if err := json.Unmarshal(*raw, &cur); err != nil {
+		return float64(0), err
+	}
+
+	for _, seg := range segments[1:] {
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return float64(0), fmt.Errorf("--result-path %q: parent of %q is not an object", path, seg)
+		}
+		cur, ok = obj[seg]
+		if !ok {
+			return float64(0), fmt.Errorf("--result-path %q: %q not found", path, seg)
+		}
+	}
+
+	val, ok := cur.(float64)
+	if !ok {
+		return float64(0), fmt.Errorf("--result-path %q does not point at a number", path)
+	}
+	return val, nil
+}
+
+// splitResultPath splits a dotted path into its segments, allowing a
+// literal dot within a segment to be escaped as "\." (needed for keys like
+// percentile values: "values.95\.0").
+func splitResultPath(path string) []string {
+	var segments []string
+	var cur strings.Builder
+	escaped := false
+
+	for _, r := range path {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '.':
+			segments = append(segments, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	segments = append(segments, cur.String())
+
+	return segments
+}